@@ -7,12 +7,10 @@ import (
 	"fmt"
 	"log"
 	"sync"
-	"sync/atomic"
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
-	"github.com/mattn/go-sqlite3"
 )
 
 // pragmas are sqlite pragmas to be applied at initialization.
@@ -45,6 +43,48 @@ var initDDL = []string{
 	`INSERT OR IGNORE INTO _meta (version) VALUES (1)`,
 }
 
+// schemaVersion is the schema version this version of the package expects;
+// migrations is walked to bring any older on-disk database up to it.
+const schemaVersion = 2
+
+// migrations holds the DDL to move from schema version N to N+1, indexed by
+// N-1, applied against the _meta table the schema reserves for this.
+var migrations = []string{
+	// version 1 -> 2: persist the original block's codec so that
+	// AllKeysChan can reconstruct the real CID instead of guessing
+	// cid.Raw. Existing rows are back-filled as cid.Raw, since that
+	// information was never recorded for them.
+	fmt.Sprintf(`ALTER TABLE blocks ADD COLUMN codec INTEGER NOT NULL DEFAULT %d`, cid.Raw),
+}
+
+// migrate brings db's schema up to schemaVersion, applying any outstanding
+// migrations in order, each inside its own transaction.
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`SELECT MAX(version) FROM _meta`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read sqlite3 blockstore schema version: %w", err)
+	}
+
+	for v := version; v < schemaVersion; v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration transaction to schema version %d: %w", v+1, err)
+		}
+		if _, err := tx.Exec(migrations[v-1]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to apply sqlite3 blockstore migration to schema version %d: %w", v+1, err)
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO _meta (version) VALUES (?)`, v+1); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to record sqlite3 blockstore schema version %d: %w", v+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit sqlite3 blockstore migration to schema version %d: %w", v+1, err)
+		}
+	}
+	return nil
+}
+
 const (
 	stmtHas = iota
 	stmtGet
@@ -52,6 +92,7 @@ const (
 	stmtPut
 	stmtDelete
 	stmtSelectAll
+	stmtCount
 )
 
 // statements are statements to prepare.
@@ -59,9 +100,10 @@ var statements = [...]string{
 	stmtHas:       "SELECT EXISTS (SELECT 1 FROM blocks WHERE mh = ?)",
 	stmtGet:       "SELECT bytes FROM blocks WHERE mh = ?",
 	stmtGetSize:   "SELECT LENGTH(bytes) FROM blocks WHERE mh = ?",
-	stmtPut:       "INSERT OR IGNORE INTO blocks (mh, bytes) VALUES (?, ?)",
+	stmtPut:       "INSERT OR IGNORE INTO blocks (mh, bytes, codec) VALUES (?, ?, ?)",
 	stmtDelete:    "DELETE FROM blocks WHERE mh = ?",
-	stmtSelectAll: "SELECT mh FROM blocks",
+	stmtSelectAll: "SELECT mh, codec FROM blocks",
+	stmtCount:     "SELECT COUNT(*) FROM blocks",
 }
 
 // Blockstore is a sqlite backed IPLD blockstore, highly optimized and
@@ -71,34 +113,41 @@ type Blockstore struct {
 	db *sql.DB
 
 	prepared [len(statements)]*sql.Stmt
+
+	maxBatchSize int
 }
 
 var _ blockstore.Blockstore = (*Blockstore)(nil)
+var _ blockstore.Viewer = (*Blockstore)(nil)
+
+// defaultMaxBatchSize is the default value for Options.MaxBatchSize.
+const defaultMaxBatchSize = 1000
 
 type Options struct {
-	// placeholder
+	// MaxBatchSize is the maximum number of blocks that PutMany/DeleteMany
+	// will write within a single sqlite transaction. Batches larger than
+	// this are chunked into multiple transactions, to bound memory usage
+	// and lock duration. 0 means the default of 1000.
+	MaxBatchSize int
+
+	// Driver selects the sqlite3 binding to register with database/sql.
+	// The zero value is DriverMattn.
+	Driver Driver
 }
 
-// counter of sqlite drivers registered; guarded by atomic.
-var counter int64
-
 // Open creates a new sqlite3-backed blockstore.
-func Open(path string, _ Options) (*Blockstore, error) {
-	driver := fmt.Sprintf("sqlite3_blockstore_%d", atomic.AddInt64(&counter, 1))
-	sql.Register(driver,
-		&sqlite3.SQLiteDriver{
-			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
-				// Execute pragmas on connection creation.
-				for _, p := range pragmas {
-					if _, err := conn.Exec(p, nil); err != nil {
-						return fmt.Errorf("failed to execute sqlite3 init pragma: %s; err: %w", p, err)
-					}
-				}
-				return nil
-			},
-		})
+func Open(path string, o Options) (*Blockstore, error) {
+	maxBatchSize := o.MaxBatchSize
+	if maxBatchSize <= 0 {
+		maxBatchSize = defaultMaxBatchSize
+	}
+
+	driver, dsnSuffix, err := registerDriver(o.Driver, pragmas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register sqlite3 driver: %w", err)
+	}
 
-	db, err := sql.Open(driver, path+"?mode=rwc")
+	db, err := sql.Open(driver, path+"?mode=rwc"+dsnSuffix)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open sqlite3 database: %w", err)
 	}
@@ -110,7 +159,11 @@ func Open(path string, _ Options) (*Blockstore, error) {
 		}
 	}
 
-	bs := &Blockstore{db: db}
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+
+	bs := &Blockstore{db: db, maxBatchSize: maxBatchSize}
 
 	// Prepare all statements.
 	for i, p := range statements {
@@ -142,6 +195,35 @@ func (b *Blockstore) Get(cid cid.Cid) (blocks.Block, error) {
 	}
 }
 
+// View implements blockstore.Viewer, exposing the underlying bytes of a
+// block to the callback without copying them into a new []byte first (as Get
+// does via blocks.NewBlockWithCid). The byte slice passed to callback is only
+// valid for the duration of the call; callers must not retain it.
+func (b *Blockstore) View(cid cid.Cid, callback func([]byte) error) error {
+	rows, err := b.prepared[stmtGet].Query(keyFromCid(cid))
+	if err != nil {
+		return fmt.Errorf("failed to view CID %s in sqlite3 blockstore: %w", cid, err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to view CID %s in sqlite3 blockstore: %w", cid, err)
+		}
+		return blockstore.ErrNotFound
+	}
+
+	// sql.RawBytes aliases the driver's internal buffer for this row
+	// instead of copying it, so the callback must run before we advance or
+	// close the rows cursor.
+	var data sql.RawBytes
+	if err := rows.Scan(&data); err != nil {
+		return fmt.Errorf("failed to scan CID %s in sqlite3 blockstore: %w", cid, err)
+	}
+
+	return callback(data)
+}
+
 func (b *Blockstore) GetSize(cid cid.Cid) (int, error) {
 	var size int
 	switch err := b.prepared[stmtGetSize].QueryRow(keyFromCid(cid)).Scan(&size); err {
@@ -161,19 +243,46 @@ func (b *Blockstore) Put(block blocks.Block) error {
 		data = block.RawData()
 	)
 
-	_, err := b.prepared[stmtPut].Exec(keyFromCid(cid), data)
+	_, err := b.prepared[stmtPut].Exec(keyFromCid(cid), data, int64(cid.Prefix().Codec))
 	if err != nil {
 		err = fmt.Errorf("failed to put block with CID %s into sqlite3 blockstore: %w", cid, err)
 	}
 	return err
 }
 
-func (b *Blockstore) PutMany(blocks []blocks.Block) error {
-	for i, blk := range blocks {
-		if err := b.Put(blk); err != nil {
-			return fmt.Errorf("failed to put block %d/%d with CID %s into sqlite3 blockstore: %w", i, len(blocks), blk.Cid(), err)
+// PutMany writes all blocks within one or more sqlite transactions, chunked
+// at Options.MaxBatchSize blocks per transaction, using a single prepared
+// insert reused for every row in the batch.
+func (b *Blockstore) PutMany(blks []blocks.Block) error {
+	for start := 0; start < len(blks); start += b.maxBatchSize {
+		end := start + b.maxBatchSize
+		if end > len(blks) {
+			end = len(blks)
+		}
+		if err := b.putMany(blks[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Blockstore) putMany(blks []blocks.Block) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for PutMany: %w", err)
+	}
+
+	stmt := tx.Stmt(b.prepared[stmtPut])
+	for i, blk := range blks {
+		if _, err := stmt.Exec(keyFromCid(blk.Cid()), blk.RawData(), int64(blk.Cid().Prefix().Codec)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to put block %d/%d with CID %s into sqlite3 blockstore: %w", i, len(blks), blk.Cid(), err)
 		}
 	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit PutMany transaction: %w", err)
+	}
 	return nil
 }
 
@@ -182,6 +291,42 @@ func (b *Blockstore) DeleteBlock(cid cid.Cid) error {
 	return err
 }
 
+// DeleteMany deletes all the supplied CIDs within one or more sqlite
+// transactions, chunked at Options.MaxBatchSize CIDs per transaction, using
+// a single prepared delete reused for every row in the batch.
+func (b *Blockstore) DeleteMany(cids []cid.Cid) error {
+	for start := 0; start < len(cids); start += b.maxBatchSize {
+		end := start + b.maxBatchSize
+		if end > len(cids) {
+			end = len(cids)
+		}
+		if err := b.deleteMany(cids[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Blockstore) deleteMany(cids []cid.Cid) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for DeleteMany: %w", err)
+	}
+
+	stmt := tx.Stmt(b.prepared[stmtDelete])
+	for i, c := range cids {
+		if _, err := stmt.Exec(keyFromCid(c)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to delete CID %d/%d %s from sqlite3 blockstore: %w", i, len(cids), c, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit DeleteMany transaction: %w", err)
+	}
+	return nil
+}
+
 func (b *Blockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
 	ret := make(chan cid.Cid)
 
@@ -198,14 +343,17 @@ func (b *Blockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
 		defer close(ret)
 
 		for q.Next() {
-			var mh string
+			var (
+				mh    string
+				codec uint64
+			)
 
-			switch err := q.Scan(&mh); {
+			switch err := q.Scan(&mh, &codec); {
 			case err == nil:
 				if mh, err := base64.RawStdEncoding.DecodeString(mh); err != nil {
 					log.Printf("failed to parse multihash when querying all keys in sqlite3 blockstore: %s", err)
 				} else {
-					ret <- cid.NewCidV1(cid.Raw, mh)
+					ret <- cid.NewCidV1(codec, mh)
 				}
 			case ctx.Err() != nil:
 				return // context was cancelled
@@ -218,6 +366,54 @@ func (b *Blockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
 	return ret, nil
 }
 
+// CopyTo streams every key/block pair from this sqlite3 blockstore into dst,
+// via PutMany batches of Options.MaxBatchSize. Useful for snapshots and for
+// migrating between backends.
+func (b *Blockstore) CopyTo(dst blockstore.Blockstore) error {
+	ctx := context.Background()
+
+	ch, err := b.AllKeysChan(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list keys to copy from sqlite3 blockstore: %w", err)
+	}
+
+	batch := make([]blocks.Block, 0, b.maxBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := dst.PutMany(batch); err != nil {
+			return fmt.Errorf("failed to copy blocks into destination blockstore: %w", err)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for c := range ch {
+		blk, err := b.Get(c)
+		if err != nil {
+			return fmt.Errorf("failed to get CID %s to copy from sqlite3 blockstore: %w", c, err)
+		}
+		batch = append(batch, blk)
+		if len(batch) >= b.maxBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// Len reports the number of blocks held in the blockstore, for use by
+// Lotus's GC / snapshot reporting.
+func (b *Blockstore) Len() (int64, error) {
+	var count int64
+	if err := b.prepared[stmtCount].QueryRow().Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count blocks in sqlite3 blockstore: %w", err)
+	}
+	return count, nil
+}
+
 func (b *Blockstore) HashOnRead(_ bool) {
 	log.Print("sqlite3 blockstore ignored HashOnRead request")
 }
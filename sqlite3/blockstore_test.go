@@ -0,0 +1,241 @@
+package sqlite3bs
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	mh "github.com/multiformats/go-multihash"
+)
+
+func mustOpen(t *testing.T, opts Options) *Blockstore {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "blocks.db")
+	bs, err := Open(path, opts)
+	if err != nil {
+		t.Fatalf("failed to open blockstore: %s", err)
+	}
+	t.Cleanup(func() { _ = bs.Close() })
+	return bs
+}
+
+func mustBlock(t *testing.T, data []byte) blocks.Block {
+	t.Helper()
+	h, err := mh.Sum(data, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatalf("failed to hash block: %s", err)
+	}
+	blk, err := blocks.NewBlockWithCid(data, cid.NewCidV1(cid.DagCBOR, h))
+	if err != nil {
+		t.Fatalf("failed to construct block: %s", err)
+	}
+	return blk
+}
+
+func TestMigrateBumpsSchemaVersion(t *testing.T) {
+	bs := mustOpen(t, Options{})
+
+	var version int
+	if err := bs.db.QueryRow(`SELECT MAX(version) FROM _meta`).Scan(&version); err != nil {
+		t.Fatalf("failed to read schema version: %s", err)
+	}
+	if version != schemaVersion {
+		t.Fatalf("expected schema version %d, got %d", schemaVersion, version)
+	}
+
+	if _, err := bs.db.Exec(`SELECT codec FROM blocks LIMIT 0`); err != nil {
+		t.Fatalf("expected codec column to exist after migration: %s", err)
+	}
+}
+
+// TestMigrateBackfillsLegacyRows hand-builds a schema-version-1 database,
+// the shape this package wrote before the codec column existed, and checks
+// that Open migrates it in place: existing rows are back-filled as
+// cid.Raw and remain readable.
+func TestMigrateBackfillsLegacyRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+
+	// mattn/go-sqlite3 self-registers under the "sqlite3" driver name on
+	// import (see its init()), which driver.go already imports.
+	raw, err := sql.Open("sqlite3", path+"?mode=rwc")
+	if err != nil {
+		t.Fatalf("failed to open raw sqlite3 database: %s", err)
+	}
+	for _, ddl := range []string{
+		`CREATE TABLE blocks (mh TEXT NOT NULL PRIMARY KEY, bytes BLOB NOT NULL) WITHOUT ROWID`,
+		`CREATE TABLE _meta (version UINT64 NOT NULL UNIQUE)`,
+		`INSERT INTO _meta (version) VALUES (1)`,
+	} {
+		if _, err := raw.Exec(ddl); err != nil {
+			t.Fatalf("failed to execute legacy DDL %s: %s", ddl, err)
+		}
+	}
+
+	blk := mustBlock(t, []byte("legacy block"))
+	if _, err := raw.Exec(`INSERT INTO blocks (mh, bytes) VALUES (?, ?)`, keyFromCid(blk.Cid()), blk.RawData()); err != nil {
+		t.Fatalf("failed to insert legacy row: %s", err)
+	}
+	if err := raw.Close(); err != nil {
+		t.Fatalf("failed to close raw sqlite3 database: %s", err)
+	}
+
+	bs, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open legacy database: %s", err)
+	}
+	t.Cleanup(func() { _ = bs.Close() })
+
+	var version int
+	if err := bs.db.QueryRow(`SELECT MAX(version) FROM _meta`).Scan(&version); err != nil {
+		t.Fatalf("failed to read schema version: %s", err)
+	}
+	if version != schemaVersion {
+		t.Fatalf("expected schema version %d after migration, got %d", schemaVersion, version)
+	}
+
+	got, err := bs.Get(blk.Cid())
+	if err != nil {
+		t.Fatalf("failed to get legacy block after migration: %s", err)
+	}
+	if string(got.RawData()) != string(blk.RawData()) {
+		t.Fatalf("expected %q, got %q", blk.RawData(), got.RawData())
+	}
+
+	var codec int
+	if err := bs.db.QueryRow(`SELECT codec FROM blocks WHERE mh = ?`, keyFromCid(blk.Cid())).Scan(&codec); err != nil {
+		t.Fatalf("failed to read codec column: %s", err)
+	}
+	if codec != int(cid.Raw) {
+		t.Fatalf("expected legacy row to be back-filled as cid.Raw (%d), got %d", cid.Raw, codec)
+	}
+}
+
+func TestViewMatchesGet(t *testing.T) {
+	bs := mustOpen(t, Options{})
+	blk := mustBlock(t, []byte("hello world"))
+
+	if err := bs.Put(blk); err != nil {
+		t.Fatalf("failed to put block: %s", err)
+	}
+
+	var viewed []byte
+	if err := bs.View(blk.Cid(), func(data []byte) error {
+		viewed = append(viewed, data...)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to view block: %s", err)
+	}
+	if string(viewed) != string(blk.RawData()) {
+		t.Fatalf("expected %q, got %q", blk.RawData(), viewed)
+	}
+}
+
+func TestViewMissing(t *testing.T) {
+	bs := mustOpen(t, Options{})
+	h, err := mh.Sum([]byte("missing"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatalf("failed to hash: %s", err)
+	}
+
+	err = bs.View(cid.NewCidV1(cid.Raw, h), func([]byte) error {
+		t.Fatal("callback should not run for a missing CID")
+		return nil
+	})
+	if err != blockstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPutManyDeleteManyChunking(t *testing.T) {
+	bs := mustOpen(t, Options{MaxBatchSize: 3})
+
+	var blks []blocks.Block
+	for i := 0; i < 10; i++ {
+		blks = append(blks, mustBlock(t, []byte{byte(i)}))
+	}
+
+	if err := bs.PutMany(blks); err != nil {
+		t.Fatalf("failed to PutMany: %s", err)
+	}
+
+	if count, err := bs.Len(); err != nil {
+		t.Fatalf("failed to Len: %s", err)
+	} else if count != int64(len(blks)) {
+		t.Fatalf("expected %d blocks, got %d", len(blks), count)
+	}
+
+	cids := make([]cid.Cid, len(blks))
+	for i, blk := range blks {
+		cids[i] = blk.Cid()
+	}
+	if err := bs.DeleteMany(cids); err != nil {
+		t.Fatalf("failed to DeleteMany: %s", err)
+	}
+
+	if count, err := bs.Len(); err != nil {
+		t.Fatalf("failed to Len: %s", err)
+	} else if count != 0 {
+		t.Fatalf("expected 0 blocks after DeleteMany, got %d", count)
+	}
+}
+
+func TestCopyToRoundTrips(t *testing.T) {
+	src := mustOpen(t, Options{MaxBatchSize: 3})
+	dst := mustOpen(t, Options{})
+
+	var blks []blocks.Block
+	for i := 0; i < 10; i++ {
+		blks = append(blks, mustBlock(t, []byte{byte(i)}))
+	}
+	if err := src.PutMany(blks); err != nil {
+		t.Fatalf("failed to seed source blockstore: %s", err)
+	}
+
+	if err := src.CopyTo(dst); err != nil {
+		t.Fatalf("failed to CopyTo destination: %s", err)
+	}
+
+	dstCount, err := dst.Len()
+	if err != nil {
+		t.Fatalf("failed to Len destination: %s", err)
+	}
+	if dstCount != int64(len(blks)) {
+		t.Fatalf("expected %d blocks copied, got %d", len(blks), dstCount)
+	}
+
+	for _, blk := range blks {
+		got, err := dst.Get(blk.Cid())
+		if err != nil {
+			t.Fatalf("failed to get copied CID %s: %s", blk.Cid(), err)
+		}
+		if string(got.RawData()) != string(blk.RawData()) {
+			t.Fatalf("expected %q, got %q", blk.RawData(), got.RawData())
+		}
+	}
+}
+
+func TestAllKeysChanPreservesCodec(t *testing.T) {
+	bs := mustOpen(t, Options{})
+	blk := mustBlock(t, []byte("codec check"))
+
+	if err := bs.Put(blk); err != nil {
+		t.Fatalf("failed to put block: %s", err)
+	}
+
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatalf("failed to list keys: %s", err)
+	}
+
+	got, ok := <-ch
+	if !ok {
+		t.Fatal("expected one key, got none")
+	}
+	if got != blk.Cid() {
+		t.Fatalf("expected CID %s, got %s", blk.Cid(), got)
+	}
+}
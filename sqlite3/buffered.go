@@ -0,0 +1,181 @@
+package sqlite3bs
+
+import (
+	"context"
+	"fmt"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// Buffered fronts a sqlite3 Blockstore with an in-memory write buffer,
+// mirroring Lotus's BufferedBlockstore (blockstore/buffered.go). VM
+// execution produces many transient intermediate blocks that should never
+// round-trip through sqlite; Put/PutMany land in the buffer, and only
+// Flush persists them to the sqlite backend.
+type Buffered struct {
+	write blockstore.Blockstore
+	read  *Blockstore
+}
+
+var _ blockstore.Blockstore = (*Buffered)(nil)
+
+// NewBuffered wraps base with an in-memory write buffer.
+func NewBuffered(base *Blockstore) *Buffered {
+	return &Buffered{
+		write: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		read:  base,
+	}
+}
+
+func (b *Buffered) Has(c cid.Cid) (bool, error) {
+	if has, err := b.write.Has(c); err != nil || has {
+		return has, err
+	}
+	return b.read.Has(c)
+}
+
+func (b *Buffered) Get(c cid.Cid) (blocks.Block, error) {
+	switch blk, err := b.write.Get(c); err {
+	case nil:
+		return blk, nil
+	case blockstore.ErrNotFound:
+		return b.read.Get(c)
+	default:
+		return nil, err
+	}
+}
+
+func (b *Buffered) GetSize(c cid.Cid) (int, error) {
+	switch size, err := b.write.GetSize(c); err {
+	case nil:
+		return size, nil
+	case blockstore.ErrNotFound:
+		return b.read.GetSize(c)
+	default:
+		return -1, err
+	}
+}
+
+func (b *Buffered) Put(blk blocks.Block) error {
+	return b.write.Put(blk)
+}
+
+func (b *Buffered) PutMany(blks []blocks.Block) error {
+	return b.write.PutMany(blks)
+}
+
+// DeleteBlock removes c from both the write buffer and the sqlite backend,
+// since a flushed block may no longer be present in the write buffer.
+func (b *Buffered) DeleteBlock(c cid.Cid) error {
+	if err := b.write.DeleteBlock(c); err != nil {
+		return fmt.Errorf("failed to delete CID %s from write buffer: %w", c, err)
+	}
+	if err := b.read.DeleteBlock(c); err != nil {
+		return fmt.Errorf("failed to delete CID %s from sqlite3 blockstore: %w", c, err)
+	}
+	return nil
+}
+
+// AllKeysChan merges the keys buffered in memory with the keys already
+// flushed to sqlite, deduping so that a CID present in both (e.g. re-put
+// after being flushed) is only emitted once. The two layers are read
+// concurrently, so keys from them are interleaved in no particular order.
+func (b *Buffered) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	writeCh, err := b.write.AllKeysChan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys of buffered write blockstore: %w", err)
+	}
+	readCh, err := b.read.AllKeysChan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys of buffered read blockstore: %w", err)
+	}
+
+	ret := make(chan cid.Cid)
+	go func() {
+		defer close(ret)
+
+		seen := make(map[cid.Cid]struct{})
+		emit := func(c cid.Cid) bool {
+			if _, ok := seen[c]; ok {
+				return true
+			}
+			seen[c] = struct{}{}
+			select {
+			case ret <- c:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for writeCh != nil || readCh != nil {
+			select {
+			case c, ok := <-writeCh:
+				if !ok {
+					writeCh = nil
+					continue
+				}
+				if !emit(c) {
+					return
+				}
+			case c, ok := <-readCh:
+				if !ok {
+					readCh = nil
+					continue
+				}
+				if !emit(c) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ret, nil
+}
+
+func (b *Buffered) HashOnRead(enabled bool) {
+	b.write.HashOnRead(enabled)
+	b.read.HashOnRead(enabled)
+}
+
+// Flush drains every block currently held in the write buffer into the
+// sqlite backend inside one batched PutMany, then empties the buffer.
+func (b *Buffered) Flush(ctx context.Context) error {
+	ch, err := b.write.AllKeysChan(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list keys of buffered write blockstore: %w", err)
+	}
+
+	var (
+		blks []blocks.Block
+		keys []cid.Cid
+	)
+	for c := range ch {
+		blk, err := b.write.Get(c)
+		if err != nil {
+			return fmt.Errorf("failed to get buffered block %s: %w", c, err)
+		}
+		blks = append(blks, blk)
+		keys = append(keys, c)
+	}
+
+	if err := b.read.PutMany(blks); err != nil {
+		return fmt.Errorf("failed to flush buffered blocks into sqlite3 blockstore: %w", err)
+	}
+
+	for _, c := range keys {
+		if err := b.write.DeleteBlock(c); err != nil {
+			return fmt.Errorf("failed to clear flushed block %s from write buffer: %w", c, err)
+		}
+	}
+	return nil
+}
+
+func (b *Buffered) Close() error {
+	return b.read.Close()
+}
@@ -0,0 +1,82 @@
+package sqlite3bs
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mattn/go-sqlite3"
+	"modernc.org/sqlite"
+)
+
+// Driver selects which SQLite binding Open registers with database/sql. The
+// schema, pragmas and prepared statements are portable across drivers; only
+// the mechanism for applying pragmas to a fresh connection differs.
+type Driver int
+
+const (
+	// DriverMattn uses github.com/mattn/go-sqlite3, a cgo binding onto the
+	// upstream C sqlite3 amalgamation. It is the default, and the most
+	// battle-tested option, but it requires CGO_ENABLED=1.
+	DriverMattn Driver = iota
+
+	// DriverModernc uses modernc.org/sqlite, a pure-Go transpilation of
+	// sqlite3 that requires no CGO and therefore no C toolchain at build
+	// time. Use this to build a Lotus node against this blockstore with
+	// CGO_ENABLED=0.
+	DriverModernc
+)
+
+// counter of sqlite drivers registered; guarded by atomic. Each Blockstore
+// registers its own database/sql driver instance so that its ConnectHook
+// closes over its own pragmas.
+var counter int64
+
+// registerDriver registers a uniquely-named database/sql driver for the
+// selected backend and returns its name, suitable for passing to sql.Open,
+// along with any DSN query parameters the backend needs appended to the
+// connection string in lieu of a connect hook.
+func registerDriver(d Driver, pragmas []string) (name, dsnSuffix string, err error) {
+	name = fmt.Sprintf("sqlite3_blockstore_%d", atomic.AddInt64(&counter, 1))
+
+	switch d {
+	case DriverMattn:
+		sql.Register(name, &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				// Without cgo, mattn/go-sqlite3 compiles a stub SQLiteConn
+				// that has no Exec method, so go through driver.Execer to
+				// keep this file building with CGO_ENABLED=0.
+				execer, ok := interface{}(conn).(driver.Execer)
+				if !ok {
+					return fmt.Errorf("sqlite3 connection cannot execute init pragmas")
+				}
+				// Execute pragmas on connection creation.
+				for _, p := range pragmas {
+					if _, err := execer.Exec(p, nil); err != nil {
+						return fmt.Errorf("failed to execute sqlite3 init pragma: %s; err: %w", p, err)
+					}
+				}
+				return nil
+			},
+		})
+		return name, "", nil
+
+	case DriverModernc:
+		sql.Register(name, &sqlite.Driver{})
+
+		// modernc.org/sqlite has no per-connection connect hook; it applies
+		// pragmas via _pragma DSN query parameters instead, one per pragma.
+		var sb strings.Builder
+		for _, p := range pragmas {
+			sb.WriteString("&_pragma=")
+			sb.WriteString(url.QueryEscape(strings.TrimPrefix(p, "PRAGMA ")))
+		}
+		return name, sb.String(), nil
+
+	default:
+		return "", "", fmt.Errorf("unknown sqlite3 driver: %d", d)
+	}
+}
@@ -0,0 +1,39 @@
+package sqlite3bs
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenWithModerncDriver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.db")
+	bs, err := Open(path, Options{Driver: DriverModernc})
+	if err != nil {
+		t.Fatalf("failed to open blockstore with modernc driver: %s", err)
+	}
+	t.Cleanup(func() { _ = bs.Close() })
+
+	blk := mustBlock(t, []byte("modernc round-trip"))
+	if err := bs.Put(blk); err != nil {
+		t.Fatalf("failed to put block: %s", err)
+	}
+
+	got, err := bs.Get(blk.Cid())
+	if err != nil {
+		t.Fatalf("failed to get block: %s", err)
+	}
+	if string(got.RawData()) != string(blk.RawData()) {
+		t.Fatalf("expected %q, got %q", blk.RawData(), got.RawData())
+	}
+
+	// Confirm the pragmas were actually applied via the DSN, rather than
+	// silently ignored, by checking one that's observable: "PRAGMA
+	// synchronous = OFF" should leave synchronous reporting 0.
+	var synchronous int
+	if err := bs.db.QueryRow(`PRAGMA synchronous`).Scan(&synchronous); err != nil {
+		t.Fatalf("failed to read synchronous pragma: %s", err)
+	}
+	if synchronous != 0 {
+		t.Fatalf("expected synchronous pragma to be applied (0, OFF), got %d", synchronous)
+	}
+}